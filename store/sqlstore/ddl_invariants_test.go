@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// These tests don't execute DDL against a real database (no driver is vendored into this module),
+// but they catch the two bug shapes that slipped through the rest of the suite: a column name
+// collision between two ADD COLUMN/CREATE TABLE statements for the same table, and an UpsertClause
+// whose conflict columns aren't actually backed by a PRIMARY KEY or UNIQUE constraint anywhere in
+// that table's DDL history.
+
+// columnDefLine matches the unquoted identifier a column definition line starts with, once
+// columnNames has trimmed the line and skipped the constraint lines in nonColumnLinePrefixes. A
+// quoted identifier (such as the quoted "key" column) doesn't match, so it isn't returned.
+var columnDefLine = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\b`)
+
+var nonColumnLinePrefixes = []string{
+	"CREATE TABLE", "PRIMARY KEY", "CONSTRAINT", "FOREIGN KEY", "REFERENCES",
+	"ON DELETE", "ON UPDATE", ")",
+}
+
+// columnNames extracts the declared column names from a single CREATE TABLE statement, in the
+// same line-per-column style every DDL builder in this package uses.
+func columnNames(createTable string) []string {
+	var cols []string
+	for _, line := range strings.Split(createTable, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, ","))
+		if line == "" {
+			continue
+		}
+		upper := strings.ToUpper(line)
+		skip := false
+		for _, prefix := range nonColumnLinePrefixes {
+			if strings.HasPrefix(upper, prefix) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		if m := columnDefLine.FindStringSubmatch(line); m != nil {
+			cols = append(cols, m[1])
+		}
+	}
+	return cols
+}
+
+// createTableStatements splits a dialect's rendered DDL into one entry per CREATE TABLE
+// statement, keyed by table name, so a table's columns can be inspected regardless of which
+// builder in store_kinds.go produced it.
+func createTableStatements(stmts []string) map[string]string {
+	out := map[string]string{}
+	tableName := regexp.MustCompile(`CREATE TABLE(?: IF NOT EXISTS)? (\S+)`)
+	for _, stmt := range stmts {
+		if m := tableName.FindStringSubmatch(stmt); m != nil {
+			out[m[1]] = stmt
+		}
+	}
+	return out
+}
+
+func allV1TableDDL(dialect Dialect) map[string]string {
+	var stmts []string
+	for _, ddl := range upgradeV1Topics {
+		stmts = append(stmts, ddl(dialect)...)
+	}
+	stmts = append(stmts, msgSecretsDDL(dialect)...)
+	stmts = append(stmts, privacyDDL(dialect)...)
+	return createTableStatements(stmts)
+}
+
+// TestEncryptionKeyIDColumnDoesNotCollide guards against the bug a real SQLite run caught: naming
+// the column upgradeV5 adds the same as an existing column on the same table fails ADD COLUMN on
+// every dialect. This reproduces that check by parsing the CREATE TABLE DDL instead.
+func TestEncryptionKeyIDColumnDoesNotCollide(t *testing.T) {
+	for _, dialectName := range []string{"postgres", "mysql", "sqlite"} {
+		dialect := dialectFor(dialectName)
+		tables := allV1TableDDL(dialect)
+		seen := map[string]bool{}
+		for _, col := range encryptedColumns {
+			if seen[col.table] {
+				continue
+			}
+			seen[col.table] = true
+			ddl, ok := tables[col.table]
+			if !ok {
+				t.Fatalf("%s: no CREATE TABLE found for %s", dialectName, col.table)
+			}
+			for _, existing := range columnNames(ddl) {
+				if existing == encKeyIDColumn {
+					t.Errorf("%s: %s already has a column named %q before upgradeV5 adds it", dialectName, col.table, encKeyIDColumn)
+				}
+			}
+		}
+	}
+}
+
+// TestNoDuplicateColumnsInCreateTable is a general version of the above: no CREATE TABLE statement
+// in the v1 schema should declare the same column name twice, since every dialect rejects that.
+func TestNoDuplicateColumnsInCreateTable(t *testing.T) {
+	dialect := dialectFor("postgres")
+	for table, ddl := range allV1TableDDL(dialect) {
+		seen := map[string]bool{}
+		for _, col := range columnNames(ddl) {
+			if seen[col] {
+				t.Errorf("%s: column %q declared more than once", table, col)
+			}
+			seen[col] = true
+		}
+	}
+}
+
+// TestMessageSecretsUpsertHasMatchingConstraint guards against the bug a real SQLite/Postgres run
+// caught: PutMessageSecret upserts on (our_jid, chat_jid, sender_jid, message_id), but v3's CREATE
+// TABLE never declared a constraint on those columns, so the upsert had nothing to conflict on.
+// upgradeV6 is supposed to add it; this checks its DDL actually covers the same columns.
+func TestMessageSecretsUpsertHasMatchingConstraint(t *testing.T) {
+	dialect := dialectFor("postgres")
+	conflictColumns := []string{"our_jid", "chat_jid", "sender_jid", "message_id"}
+
+	var indexDDL string
+	for _, stmt := range upgradeV6DDL(dialect) {
+		if strings.Contains(stmt, "whatsmeow_message_secrets") {
+			indexDDL = stmt
+		}
+	}
+	if indexDDL == "" {
+		t.Fatal("upgradeV6DDL doesn't touch whatsmeow_message_secrets")
+	}
+	if !strings.Contains(strings.ToUpper(indexDDL), "UNIQUE") {
+		t.Fatalf("upgradeV6DDL statement isn't a unique constraint: %s", indexDDL)
+	}
+	for _, col := range conflictColumns {
+		if !strings.Contains(indexDDL, col) {
+			t.Errorf("upgradeV6DDL's unique constraint doesn't mention upsert conflict column %q: %s", col, indexDDL)
+		}
+	}
+}
+
+// TestCreateTableStatementsAreIdempotent guards against the EnableStores/Upgrade mixing bug: every
+// table-creating statement must tolerate running twice (e.g. because EnableStores already created
+// the table before Upgrade runs v1), so each one must use IF NOT EXISTS.
+func TestCreateTableStatementsAreIdempotent(t *testing.T) {
+	dialect := dialectFor("postgres")
+	for table, ddl := range allV1TableDDL(dialect) {
+		if !strings.Contains(ddl, "CREATE TABLE IF NOT EXISTS") {
+			t.Errorf("%s: CREATE TABLE statement isn't idempotent (missing IF NOT EXISTS)", table)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PlaceholderStyle describes how a dialect expects bound query parameters to be written.
+type PlaceholderStyle int
+
+const (
+	// PlaceholderQuestion is the "?" style used by MySQL and SQLite.
+	PlaceholderQuestion PlaceholderStyle = iota
+	// PlaceholderDollar is the "$1", "$2", ... style used by Postgres.
+	PlaceholderDollar
+)
+
+// Dialect abstracts the SQL differences between the database engines whatsmeow supports, so a
+// single migration (or store query) can emit engine-correct SQL instead of branching on
+// Container.dialect by hand.
+type Dialect interface {
+	// Name returns the dialect's identifier, matching the driver name passed to New/NewWithDB
+	// ("postgres", "pgx", "sqlite3", "sqlite", "mysql", ...).
+	Name() string
+	// BlobType returns the column type used to store arbitrary binary data.
+	BlobType() string
+	// BoolType returns the column type used to store booleans.
+	BoolType() string
+	// BoolLiteral renders a boolean as a literal this dialect accepts in SQL text (e.g. "TRUE"/"FALSE"
+	// vs "1"/"0").
+	BoolLiteral(value bool) string
+	// QuoteIdent quotes name as an identifier, escaping reserved words like "key".
+	QuoteIdent(name string) string
+	// UpsertClause returns the clause appended to an INSERT to make it an upsert: on a conflict on
+	// conflictColumns, update updateColumns to the values that were being inserted.
+	UpsertClause(conflictColumns, updateColumns []string) string
+	// PlaceholderStyle returns how this dialect expects bound parameters to be written.
+	PlaceholderStyle() PlaceholderStyle
+}
+
+type postgresDialect struct{ name string }
+
+func (d postgresDialect) Name() string                 { return d.name }
+func (d postgresDialect) BlobType() string              { return "bytea" }
+func (d postgresDialect) BoolType() string              { return "BOOLEAN" }
+func (d postgresDialect) BoolLiteral(v bool) string {
+	if v {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+func (d postgresDialect) QuoteIdent(name string) string { return `"` + strings.ReplaceAll(name, `"`, `""`) + `"` }
+func (d postgresDialect) PlaceholderStyle() PlaceholderStyle { return PlaceholderDollar }
+func (d postgresDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	sets := make([]string, len(updateColumns))
+	for i, col := range updateColumns {
+		sets[i] = fmt.Sprintf("%s=EXCLUDED.%s", col, col)
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflictColumns, ", "), strings.Join(sets, ", "))
+}
+
+type sqliteDialect struct{ name string }
+
+func (d sqliteDialect) Name() string                 { return d.name }
+func (d sqliteDialect) BlobType() string              { return "BLOB" }
+func (d sqliteDialect) BoolType() string              { return "BOOLEAN" }
+func (d sqliteDialect) BoolLiteral(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+func (d sqliteDialect) QuoteIdent(name string) string { return `"` + strings.ReplaceAll(name, `"`, `""`) + `"` }
+func (d sqliteDialect) PlaceholderStyle() PlaceholderStyle { return PlaceholderQuestion }
+func (d sqliteDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	sets := make([]string, len(updateColumns))
+	for i, col := range updateColumns {
+		sets[i] = fmt.Sprintf("%s=excluded.%s", col, col)
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflictColumns, ", "), strings.Join(sets, ", "))
+}
+
+type mysqlDialect struct{ name string }
+
+func (d mysqlDialect) Name() string                 { return d.name }
+func (d mysqlDialect) BlobType() string              { return "LONGBLOB" }
+func (d mysqlDialect) BoolType() string              { return "BOOLEAN" }
+func (d mysqlDialect) BoolLiteral(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+func (d mysqlDialect) QuoteIdent(name string) string { return "`" + strings.ReplaceAll(name, "`", "``") + "`" }
+func (d mysqlDialect) PlaceholderStyle() PlaceholderStyle { return PlaceholderQuestion }
+func (d mysqlDialect) UpsertClause(conflictColumns, updateColumns []string) string {
+	sets := make([]string, len(updateColumns))
+	for i, col := range updateColumns {
+		sets[i] = fmt.Sprintf("%s=VALUES(%s)", col, col)
+	}
+	return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s", strings.Join(sets, ", "))
+}
+
+// placeholders generates successive bound-parameter placeholders for a dialect's PlaceholderStyle,
+// so query builders that emit more than one parameter (like rotateBatch's per-row UPDATEs) don't
+// have to track "?" vs "$1, $2, ..." numbering by hand.
+type placeholders struct {
+	style PlaceholderStyle
+	n     int
+}
+
+func newPlaceholders(style PlaceholderStyle) *placeholders {
+	return &placeholders{style: style}
+}
+
+func (p *placeholders) next() string {
+	p.n++
+	if p.style == PlaceholderDollar {
+		return fmt.Sprintf("$%d", p.n)
+	}
+	return "?"
+}
+
+// dialectFor returns the Dialect implementation matching a Container's dialect string.
+func dialectFor(name string) Dialect {
+	switch name {
+	case "postgres", "pgx":
+		return postgresDialect{name: name}
+	case "mysql":
+		return mysqlDialect{name: name}
+	default:
+		return sqliteDialect{name: name}
+	}
+}
+
+// Dialect returns the Dialect implementation matching this Container's database engine, so store
+// code can build dialect-correct SQL the same way migrations do.
+func (c *Container) Dialect() Dialect {
+	return dialectFor(c.dialect)
+}
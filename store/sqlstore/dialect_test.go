@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import "testing"
+
+func TestDialectForKnownNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		blobType string
+		boolLit  string
+	}{
+		{"postgres", "bytea", "TRUE"},
+		{"pgx", "bytea", "TRUE"},
+		{"mysql", "LONGBLOB", "1"},
+		{"sqlite3", "BLOB", "1"},
+		{"sqlite", "BLOB", "1"},
+		{"unknown-driver", "BLOB", "1"}, // unrecognized names fall back to the sqlite dialect
+	}
+	for _, tc := range tests {
+		d := dialectFor(tc.name)
+		if d.Name() != tc.name {
+			t.Errorf("%s: Name() = %q, want %q", tc.name, d.Name(), tc.name)
+		}
+		if d.BlobType() != tc.blobType {
+			t.Errorf("%s: BlobType() = %q, want %q", tc.name, d.BlobType(), tc.blobType)
+		}
+		if got := d.BoolLiteral(true); got != tc.boolLit {
+			t.Errorf("%s: BoolLiteral(true) = %q, want %q", tc.name, got, tc.boolLit)
+		}
+	}
+}
+
+func TestDialectBoolLiteralFalse(t *testing.T) {
+	if got := dialectFor("postgres").BoolLiteral(false); got != "FALSE" {
+		t.Errorf("postgres BoolLiteral(false) = %q, want FALSE", got)
+	}
+	if got := dialectFor("mysql").BoolLiteral(false); got != "0" {
+		t.Errorf("mysql BoolLiteral(false) = %q, want 0", got)
+	}
+	if got := dialectFor("sqlite").BoolLiteral(false); got != "0" {
+		t.Errorf("sqlite BoolLiteral(false) = %q, want 0", got)
+	}
+}
+
+func TestDialectQuoteIdentEscapesQuotes(t *testing.T) {
+	if got := dialectFor("postgres").QuoteIdent(`we"ird`); got != `"we""ird"` {
+		t.Errorf("postgres QuoteIdent = %q, want %q", got, `"we""ird"`)
+	}
+	if got := dialectFor("mysql").QuoteIdent("we`ird"); got != "`we``ird`" {
+		t.Errorf("mysql QuoteIdent = %q, want %q", got, "`we``ird`")
+	}
+}
+
+func TestDialectPlaceholderStyle(t *testing.T) {
+	if dialectFor("postgres").PlaceholderStyle() != PlaceholderDollar {
+		t.Error("postgres should use PlaceholderDollar")
+	}
+	if dialectFor("pgx").PlaceholderStyle() != PlaceholderDollar {
+		t.Error("pgx should use PlaceholderDollar")
+	}
+	for _, name := range []string{"mysql", "sqlite", "sqlite3"} {
+		if dialectFor(name).PlaceholderStyle() != PlaceholderQuestion {
+			t.Errorf("%s should use PlaceholderQuestion", name)
+		}
+	}
+}
+
+func TestDialectUpsertClause(t *testing.T) {
+	conflict := []string{"jid"}
+	update := []string{"push_name"}
+
+	pg := dialectFor("postgres").UpsertClause(conflict, update)
+	if pg != "ON CONFLICT (jid) DO UPDATE SET push_name=EXCLUDED.push_name" {
+		t.Errorf("postgres UpsertClause = %q", pg)
+	}
+
+	sqlite := dialectFor("sqlite").UpsertClause(conflict, update)
+	if sqlite != "ON CONFLICT (jid) DO UPDATE SET push_name=excluded.push_name" {
+		t.Errorf("sqlite UpsertClause = %q", sqlite)
+	}
+
+	mysql := dialectFor("mysql").UpsertClause(conflict, update)
+	if mysql != "ON DUPLICATE KEY UPDATE push_name=VALUES(push_name)" {
+		t.Errorf("mysql UpsertClause = %q", mysql)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ignoreNoRows turns sql.ErrNoRows into a nil error, so Get* methods can report "not found" as a
+// nil result instead of making every caller special-case sql.ErrNoRows.
+func ignoreNoRows(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// GetDeviceKeys returns the long-term key material stored for jid in whatsmeow_device (noise key,
+// identity key, signed prekey and adv key), transparently decrypting each if this Container has an
+// EncryptionProvider. The rest of the device row (registration ID, signatures, profile fields) is
+// plaintext and isn't this method's concern.
+func (c *Container) GetDeviceKeys(jid string) (noiseKey, identityKey, signedPreKey, advKey []byte, err error) {
+	row := c.db.QueryRow("SELECT noise_key, identity_key, signed_pre_key, adv_key FROM whatsmeow_device WHERE jid=?", jid)
+	if err = row.Scan(&noiseKey, &identityKey, &signedPreKey, &advKey); err != nil {
+		return nil, nil, nil, nil, ignoreNoRows(err)
+	}
+	if noiseKey, err = c.decryptColumn(noiseKey); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("decrypting noise key: %w", err)
+	}
+	if identityKey, err = c.decryptColumn(identityKey); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("decrypting identity key: %w", err)
+	}
+	if signedPreKey, err = c.decryptColumn(signedPreKey); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("decrypting signed prekey: %w", err)
+	}
+	if advKey, err = c.decryptColumn(advKey); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("decrypting adv key: %w", err)
+	}
+	return noiseKey, identityKey, signedPreKey, advKey, nil
+}
+
+// PutDeviceKeys updates the long-term key material stored for jid in whatsmeow_device,
+// transparently encrypting each column this Container has an EncryptionProvider for.
+func (c *Container) PutDeviceKeys(jid string, noiseKey, identityKey, signedPreKey, advKey []byte) error {
+	var err error
+	if noiseKey, err = c.encryptColumn(noiseKey); err != nil {
+		return fmt.Errorf("encrypting noise key: %w", err)
+	}
+	if identityKey, err = c.encryptColumn(identityKey); err != nil {
+		return fmt.Errorf("encrypting identity key: %w", err)
+	}
+	if signedPreKey, err = c.encryptColumn(signedPreKey); err != nil {
+		return fmt.Errorf("encrypting signed prekey: %w", err)
+	}
+	if advKey, err = c.encryptColumn(advKey); err != nil {
+		return fmt.Errorf("encrypting adv key: %w", err)
+	}
+	_, err = c.db.Exec(
+		fmt.Sprintf("UPDATE whatsmeow_device SET noise_key=?, identity_key=?, signed_pre_key=?, adv_key=?, %s=? WHERE jid=?", encKeyIDColumn),
+		noiseKey, identityKey, signedPreKey, advKey, c.currentKeyID(), jid)
+	return err
+}
+
+// PutIdentity stores the identity key for our_jid's session with their_id, transparently
+// encrypting it if this Container has an EncryptionProvider.
+func (c *Container) PutIdentity(ourJID, theirID string, identity []byte) error {
+	identity, err := c.encryptColumn(identity)
+	if err != nil {
+		return fmt.Errorf("encrypting identity key: %w", err)
+	}
+	upsert := c.Dialect().UpsertClause([]string{"our_jid", "their_id"}, []string{"identity", encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_identity_keys (our_jid, their_id, identity, %s) VALUES (?, ?, ?, ?) %s", encKeyIDColumn, upsert),
+		ourJID, theirID, identity, c.currentKeyID())
+	return err
+}
+
+// GetIdentity returns the identity key stored for our_jid's session with their_id, transparently
+// decrypting it if this Container has an EncryptionProvider. It returns nil, nil if no row exists.
+func (c *Container) GetIdentity(ourJID, theirID string) ([]byte, error) {
+	var identity []byte
+	row := c.db.QueryRow("SELECT identity FROM whatsmeow_identity_keys WHERE our_jid=? AND their_id=?", ourJID, theirID)
+	if err := row.Scan(&identity); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(identity)
+}
+
+// PutSession stores the Signal session for our_jid's conversation with their_id, transparently
+// encrypting it if this Container has an EncryptionProvider.
+func (c *Container) PutSession(ourJID, theirID string, session []byte) error {
+	session, err := c.encryptColumn(session)
+	if err != nil {
+		return fmt.Errorf("encrypting session: %w", err)
+	}
+	upsert := c.Dialect().UpsertClause([]string{"our_jid", "their_id"}, []string{"session", encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_sessions (our_jid, their_id, session, %s) VALUES (?, ?, ?, ?) %s", encKeyIDColumn, upsert),
+		ourJID, theirID, session, c.currentKeyID())
+	return err
+}
+
+// GetSession returns the Signal session stored for our_jid's conversation with their_id,
+// transparently decrypting it if this Container has an EncryptionProvider. It returns nil, nil if
+// no row exists.
+func (c *Container) GetSession(ourJID, theirID string) ([]byte, error) {
+	var session []byte
+	row := c.db.QueryRow("SELECT session FROM whatsmeow_sessions WHERE our_jid=? AND their_id=?", ourJID, theirID)
+	if err := row.Scan(&session); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(session)
+}
+
+// PutPreKey stores jid's prekey keyID, transparently encrypting it if this Container has an
+// EncryptionProvider.
+func (c *Container) PutPreKey(jid string, keyID uint32, key []byte, uploaded bool) error {
+	key, err := c.encryptColumn(key)
+	if err != nil {
+		return fmt.Errorf("encrypting prekey: %w", err)
+	}
+	column := c.Dialect().QuoteIdent("key")
+	upsert := c.Dialect().UpsertClause([]string{"jid", "key_id"}, []string{column, "uploaded", encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_pre_keys (jid, key_id, %s, uploaded, %s) VALUES (?, ?, ?, ?, ?) %s", column, encKeyIDColumn, upsert),
+		jid, keyID, key, uploaded, c.currentKeyID())
+	return err
+}
+
+// GetPreKey returns jid's prekey keyID, transparently decrypting it if this Container has an
+// EncryptionProvider. It returns nil, nil if no row exists.
+func (c *Container) GetPreKey(jid string, keyID uint32) ([]byte, error) {
+	column := c.Dialect().QuoteIdent("key")
+	var key []byte
+	row := c.db.QueryRow(fmt.Sprintf("SELECT %s FROM whatsmeow_pre_keys WHERE jid=? AND key_id=?", column), jid, keyID)
+	if err := row.Scan(&key); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(key)
+}
+
+// PutSenderKey stores the sender key our_jid has for sender_id in chat_id, transparently
+// encrypting it if this Container has an EncryptionProvider.
+func (c *Container) PutSenderKey(ourJID, chatID, senderID string, senderKey []byte) error {
+	senderKey, err := c.encryptColumn(senderKey)
+	if err != nil {
+		return fmt.Errorf("encrypting sender key: %w", err)
+	}
+	upsert := c.Dialect().UpsertClause([]string{"our_jid", "chat_id", "sender_id"}, []string{"sender_key", encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_sender_keys (our_jid, chat_id, sender_id, sender_key, %s) VALUES (?, ?, ?, ?, ?) %s", encKeyIDColumn, upsert),
+		ourJID, chatID, senderID, senderKey, c.currentKeyID())
+	return err
+}
+
+// GetSenderKey returns the sender key our_jid has for sender_id in chat_id, transparently
+// decrypting it if this Container has an EncryptionProvider. It returns nil, nil if no row exists.
+func (c *Container) GetSenderKey(ourJID, chatID, senderID string) ([]byte, error) {
+	var senderKey []byte
+	row := c.db.QueryRow(
+		"SELECT sender_key FROM whatsmeow_sender_keys WHERE our_jid=? AND chat_id=? AND sender_id=?",
+		ourJID, chatID, senderID)
+	if err := row.Scan(&senderKey); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(senderKey)
+}
+
+// PutAppStateSyncKey stores jid's app state sync key keyID, transparently encrypting it if this
+// Container has an EncryptionProvider.
+func (c *Container) PutAppStateSyncKey(jid, keyID string, keyData []byte, timestamp int64, fingerprint []byte) error {
+	keyData, err := c.encryptColumn(keyData)
+	if err != nil {
+		return fmt.Errorf("encrypting app state sync key: %w", err)
+	}
+	upsert := c.Dialect().UpsertClause([]string{"jid", "key_id"}, []string{"key_data", "timestamp", "fingerprint", encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_app_state_sync_keys (jid, key_id, key_data, timestamp, fingerprint, %s) VALUES (?, ?, ?, ?, ?, ?) %s", encKeyIDColumn, upsert),
+		jid, keyID, keyData, timestamp, fingerprint, c.currentKeyID())
+	return err
+}
+
+// GetAppStateSyncKey returns jid's app state sync key keyID, transparently decrypting it if this
+// Container has an EncryptionProvider. It returns nil, nil if no row exists.
+func (c *Container) GetAppStateSyncKey(jid, keyID string) ([]byte, error) {
+	var keyData []byte
+	row := c.db.QueryRow("SELECT key_data FROM whatsmeow_app_state_sync_keys WHERE jid=? AND key_id=?", jid, keyID)
+	if err := row.Scan(&keyData); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(keyData)
+}
+
+// PutMessageSecret stores the pairwise message secret for messageID, transparently encrypting it
+// if this Container has an EncryptionProvider.
+func (c *Container) PutMessageSecret(ourJID, chatJID, senderJID, messageID string, key []byte) error {
+	key, err := c.encryptColumn(key)
+	if err != nil {
+		return fmt.Errorf("encrypting message secret: %w", err)
+	}
+	column := c.Dialect().QuoteIdent("key")
+	upsert := c.Dialect().UpsertClause(
+		[]string{"our_jid", "chat_jid", "sender_jid", "message_id"}, []string{column, encKeyIDColumn})
+	_, err = c.db.Exec(
+		fmt.Sprintf("INSERT INTO whatsmeow_message_secrets (our_jid, chat_jid, sender_jid, message_id, %s, %s) VALUES (?, ?, ?, ?, ?, ?) %s", column, encKeyIDColumn, upsert),
+		ourJID, chatJID, senderJID, messageID, key, c.currentKeyID())
+	return err
+}
+
+// GetMessageSecret returns the pairwise message secret stored for messageID, transparently
+// decrypting it if this Container has an EncryptionProvider. It returns nil, nil if no row exists.
+func (c *Container) GetMessageSecret(ourJID, chatJID, senderJID, messageID string) ([]byte, error) {
+	column := c.Dialect().QuoteIdent("key")
+	var key []byte
+	row := c.db.QueryRow(
+		fmt.Sprintf("SELECT %s FROM whatsmeow_message_secrets WHERE our_jid=? AND chat_jid=? AND sender_jid=? AND message_id=?", column),
+		ourJID, chatJID, senderJID, messageID)
+	if err := row.Scan(&key); err != nil {
+		return nil, ignoreNoRows(err)
+	}
+	return c.decryptColumn(key)
+}
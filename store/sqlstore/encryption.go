@@ -0,0 +1,250 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// EncryptionProvider lets a Container transparently encrypt sensitive key material before it's
+// written to the database and decrypt it on read, so operators can persist WhatsApp session state
+// on shared or managed databases without exposing raw Signal state.
+type EncryptionProvider interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+	// KeyID identifies the key used to encrypt. It's stored alongside each encrypted row so
+	// RotateEncryptionKey knows which rows still need rotating after a key change.
+	KeyID() string
+}
+
+// encryptedColumn is one column that NewWithEncryption transparently encrypts/decrypts, plus the
+// primary key columns needed to address its row when rotating.
+type encryptedColumn struct {
+	table      string
+	column     string
+	primaryKey []string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{"whatsmeow_device", "noise_key", []string{"jid"}},
+	{"whatsmeow_device", "identity_key", []string{"jid"}},
+	{"whatsmeow_device", "signed_pre_key", []string{"jid"}},
+	{"whatsmeow_device", "adv_key", []string{"jid"}},
+	{"whatsmeow_identity_keys", "identity", []string{"our_jid", "their_id"}},
+	{"whatsmeow_sessions", "session", []string{"our_jid", "their_id"}},
+	{"whatsmeow_pre_keys", "key", []string{"jid", "key_id"}},
+	{"whatsmeow_sender_keys", "sender_key", []string{"our_jid", "chat_id", "sender_id"}},
+	{"whatsmeow_app_state_sync_keys", "key_data", []string{"jid", "key_id"}},
+	{"whatsmeow_message_secrets", "key", []string{"our_jid", "chat_jid", "sender_jid", "message_id"}},
+}
+
+// encKeyIDColumn is the column upgradeV5 adds to every table in encryptedColumns to tag which
+// EncryptionProvider encrypted that row. It's deliberately not "key_id": whatsmeow_pre_keys and
+// whatsmeow_app_state_sync_keys already have their own unrelated "key_id" column (the prekey ID /
+// app state key ID, which is also part of those tables' primaryKey below), and ADD COLUMN with a
+// name that collides with an existing column fails on every dialect.
+const encKeyIDColumn = "enc_key_id"
+
+var encryptionProviders sync.Map // map[*Container]EncryptionProvider
+
+// NewWithEncryption is like New, but transparently encrypts the sensitive columns sqlstore
+// persists (identity keys, prekeys, sessions, sender keys, app state keys and message secrets)
+// before writing them and decrypts them on read. Use Container.RotateEncryptionKey to move
+// existing rows to a new EncryptionProvider later.
+func NewWithEncryption(dialect, address string, log waLog.Logger, encryption EncryptionProvider) (*Container, error) {
+	container, err := New(dialect, address, log)
+	if err != nil {
+		return nil, err
+	}
+	encryptionProviders.Store(container, encryption)
+	return container, nil
+}
+
+func (c *Container) encryptionProvider() (EncryptionProvider, bool) {
+	v, ok := encryptionProviders.Load(c)
+	if !ok {
+		return nil, false
+	}
+	return v.(EncryptionProvider), true
+}
+
+func (c *Container) encryptColumn(plaintext []byte) ([]byte, error) {
+	enc, ok := c.encryptionProvider()
+	if !ok {
+		return plaintext, nil
+	}
+	return enc.Encrypt(plaintext)
+}
+
+func (c *Container) decryptColumn(ciphertext []byte) ([]byte, error) {
+	enc, ok := c.encryptionProvider()
+	if !ok {
+		return ciphertext, nil
+	}
+	return enc.Decrypt(ciphertext)
+}
+
+// currentKeyID returns the enc_key_id value a newly-written encrypted row should be tagged with: the
+// active EncryptionProvider's KeyID, or nil (SQL NULL) if this Container has none.
+func (c *Container) currentKeyID() any {
+	if enc, ok := c.encryptionProvider(); ok {
+		return enc.KeyID()
+	}
+	return nil
+}
+
+func upgradeV5DDL(Dialect) []string {
+	seen := map[string]bool{}
+	var ddl []string
+	for _, col := range encryptedColumns {
+		if seen[col.table] {
+			continue
+		}
+		seen[col.table] = true
+		ddl = append(ddl, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s VARCHAR(64)", col.table, encKeyIDColumn))
+	}
+	return ddl
+}
+
+func upgradeV5(ctx context.Context, tx *sql.Tx, container *Container) error {
+	return execDDL(ctx, tx, container.Dialect(), upgradeV5DDL)
+}
+
+func init() {
+	registerMigration(Migration{
+		Namespace: whatsmeowNamespace,
+		Version:   5,
+		Name:      "v5: add enc_key_id columns for encryption key rotation",
+		Up:        upgradeV5,
+		Preview:   upgradeV5DDL,
+	})
+}
+
+// RotateEncryptionKey re-encrypts every row tagged with old's KeyID using new, one table at a
+// time, batching each table's rows inside its own transaction so rotating a large database
+// doesn't hold one huge lock for the whole operation.
+//
+// Rows with a NULL enc_key_id (nothing has ever called encryptColumn on them: either this
+// Container never had an EncryptionProvider before now, or they predate upgradeV5) are treated as
+// belonging to old and are passed through old.Decrypt. If old rows were written before any
+// encryption was configured, old must be a no-op EncryptionProvider (Encrypt/Decrypt returning
+// their input unchanged) rather than a real one, or this call will fail trying to decrypt
+// plaintext as ciphertext.
+func (c *Container) RotateEncryptionKey(old, new EncryptionProvider) error {
+	const batchSize = 500
+	byTable := map[string][]encryptedColumn{}
+	var tableOrder []string
+	for _, col := range encryptedColumns {
+		if _, ok := byTable[col.table]; !ok {
+			tableOrder = append(tableOrder, col.table)
+		}
+		byTable[col.table] = append(byTable[col.table], col)
+	}
+
+	for _, table := range tableOrder {
+		for {
+			n, err := c.rotateBatch(table, byTable[table], old, new, batchSize)
+			if err != nil {
+				return fmt.Errorf("rotating %s: %w", table, err)
+			}
+			if n < batchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Container) rotateBatch(table string, cols []encryptedColumn, old, new EncryptionProvider, batchSize int) (int, error) {
+	dialect := c.Dialect()
+	ph := newPlaceholders(dialect.PlaceholderStyle())
+
+	pk := cols[0].primaryKey
+	quotedCols := make([]string, len(cols))
+	for i, col := range cols {
+		quotedCols[i] = dialect.QuoteIdent(col.column)
+	}
+	selectCols := append(append([]string{}, pk...), quotedCols...)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s=%s OR %s IS NULL LIMIT %d", strings.Join(selectCols, ", "), table, encKeyIDColumn, ph.next(), encKeyIDColumn, batchSize)
+	rows, err := tx.Query(query, old.KeyID())
+	if err != nil {
+		return 0, err
+	}
+
+	type row struct {
+		pkValues []any
+		values   [][]byte
+	}
+	var batch []row
+	for rows.Next() {
+		dest := make([]any, len(selectCols))
+		pkValues := make([]any, len(pk))
+		for i := range pk {
+			dest[i] = &pkValues[i]
+		}
+		values := make([][]byte, len(cols))
+		for i := range cols {
+			dest[len(pk)+i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row{pkValues: pkValues, values: values})
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	for _, r := range batch {
+		uph := newPlaceholders(dialect.PlaceholderStyle())
+		setClauses := make([]string, len(cols)+1)
+		args := make([]any, 0, len(cols)+1+len(pk))
+		for i, col := range cols {
+			plaintext, err := old.Decrypt(r.values[i])
+			if err != nil {
+				return 0, err
+			}
+			ciphertext, err := new.Encrypt(plaintext)
+			if err != nil {
+				return 0, err
+			}
+			setClauses[i] = fmt.Sprintf("%s=%s", dialect.QuoteIdent(col.column), uph.next())
+			args = append(args, ciphertext)
+		}
+		setClauses[len(cols)] = encKeyIDColumn + "=" + uph.next()
+		args = append(args, new.KeyID())
+
+		whereClauses := make([]string, len(pk))
+		for i, col := range pk {
+			whereClauses[i] = fmt.Sprintf("%s=%s", dialect.QuoteIdent(col), uph.next())
+		}
+		args = append(args, r.pkValues...)
+
+		update := fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
+		if _, err = tx.Exec(update, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), tx.Commit()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+)
+
+// ErrMigrationLockTimeout is returned by UpgradeWithLockTimeout when another instance is still
+// holding the migration lock once timeout elapses.
+var ErrMigrationLockTimeout = errors.New("sqlstore: timed out waiting for another instance to finish migrating")
+
+const migrationLockName = "whatsmeow_migrations"
+
+// UpgradeWithLockTimeout is like Upgrade, but first takes a dialect-appropriate advisory lock so
+// that multiple whatsmeow processes sharing a database (common in HA bridge deployments) don't
+// race each other's CREATE TABLE/ALTER TABLE statements. It returns ErrMigrationLockTimeout if
+// another instance is still migrating when timeout elapses.
+func (c *Container) UpgradeWithLockTimeout(ctx context.Context, timeout time.Duration) error {
+	unlock, err := c.acquireMigrationLock(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.UpgradeContext(ctx)
+}
+
+func (c *Container) acquireMigrationLock(ctx context.Context, timeout time.Duration) (func(), error) {
+	switch c.dialect {
+	case "postgres", "pgx":
+		return c.acquirePostgresLock(ctx, timeout)
+	case "mysql":
+		return c.acquireMySQLLock(ctx, timeout)
+	default:
+		return c.acquireSQLiteLock(ctx, timeout)
+	}
+}
+
+func migrationLockKey() int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(migrationLockName))
+	return int64(h.Sum64())
+}
+
+func (c *Container) acquirePostgresLock(ctx context.Context, timeout time.Duration) (func(), error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err = conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", migrationLockKey()); err != nil {
+		_ = conn.Close()
+		if errors.Is(lockCtx.Err(), context.DeadlineExceeded) {
+			return nil, ErrMigrationLockTimeout
+		}
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey())
+		_ = conn.Close()
+	}, nil
+}
+
+func (c *Container) acquireMySQLLock(ctx context.Context, timeout time.Duration) (func(), error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var acquired sql.NullInt64
+	row := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, int(timeout.Seconds()))
+	if err = row.Scan(&acquired); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if acquired.Int64 != 1 {
+		_ = conn.Close()
+		return nil, ErrMigrationLockTimeout
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+		_ = conn.Close()
+	}, nil
+}
+
+// acquireSQLiteLock doesn't take a real named lock: SQLite has no advisory locks, and holding an
+// open transaction here would deadlock against the separate per-migration transactions
+// upgradeNamespace opens on the same *sql.DB. Instead it's an application-level lock: a single-row
+// table whose holder column is swapped from NULL to a unique token with a plain (non-transactional,
+// auto-committing) statement, so it never competes with the migration transactions for SQLite's one
+// writer slot for longer than that single statement.
+func (c *Container) acquireSQLiteLock(ctx context.Context, timeout time.Duration) (func(), error) {
+	if _, err := c.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS whatsmeow_migration_lock (id INTEGER PRIMARY KEY CHECK (id = 1), holder TEXT)"); err != nil {
+		return nil, err
+	}
+	token := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := c.db.ExecContext(ctx,
+			"INSERT INTO whatsmeow_migration_lock (id, holder) VALUES (1, ?) "+
+				"ON CONFLICT (id) DO UPDATE SET holder=excluded.holder WHERE whatsmeow_migration_lock.holder IS NULL",
+			token)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return func() {
+				_, _ = c.db.ExecContext(context.Background(),
+					"UPDATE whatsmeow_migration_lock SET holder=NULL WHERE id=1 AND holder=?", token)
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrMigrationLockTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import "testing"
+
+func TestMigrationLockKeyIsDeterministic(t *testing.T) {
+	a := migrationLockKey()
+	b := migrationLockKey()
+	if a != b {
+		t.Fatalf("migrationLockKey() returned different values: %d != %d", a, b)
+	}
+	if a == 0 {
+		t.Fatal("migrationLockKey() returned 0, expected a non-zero hash")
+	}
+}
@@ -0,0 +1,532 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// whatsmeowNamespace is the migration namespace whatsmeow's own built-in migrations are
+// registered under. Integrators registering their own migrations with RegisterMigration should
+// pick a different namespace so their version numbers don't collide with whatsmeow's.
+const whatsmeowNamespace = "whatsmeow"
+
+// ErrUnknownVersion is returned by Upgrade when the database is already at a version newer than
+// any migration this binary knows about. Running an older binary against a newer database is
+// almost always a mistake (e.g. a bad rollback), so Upgrade refuses to touch the schema rather
+// than silently leaving it as-is.
+var ErrUnknownVersion = errors.New("sqlstore: database schema is newer than this binary understands")
+
+// Migration describes a single versioned schema change that Container.Upgrade can apply.
+//
+// Third-party integrators (e.g. bridges that store extra data alongside whatsmeow's device data)
+// can register their own migrations with Container.RegisterMigration so they're tracked in the
+// same whatsmeow_version table, under a namespace of their choosing.
+type Migration struct {
+	// Namespace groups this migration with others that share a version sequence. whatsmeow's own
+	// migrations use the "whatsmeow" namespace; pick something else to avoid colliding with it.
+	Namespace string
+	// Version is this migration's position within its namespace. Versions must be registered
+	// sequentially starting at 1.
+	Version int
+	// Name is a short human-readable description, shown by MigrationStatus and in upgrade logs.
+	Name string
+	// Up applies the migration. It should honor ctx cancellation for long-running steps (e.g. a
+	// data-filling UPDATE over a large table) so shutdown can abort cleanly between statements.
+	Up func(ctx context.Context, tx *sql.Tx, container *Container) error
+	// Down reverts the migration. It may be left nil if the migration can't be cleanly reverted;
+	// UpgradeTo then refuses to roll back past it.
+	Down func(ctx context.Context, tx *sql.Tx, container *Container) error
+	// Idempotent marks Up as safe to re-run against a database it has already been applied to
+	// (e.g. because it only uses CREATE TABLE IF NOT EXISTS). It's descriptive only: Upgrade and
+	// UpgradeTo don't read it, and run Up once for each pending version either way.
+	Idempotent bool
+	// Preview returns the DDL statements Up would execute for dialect, without running them. It's
+	// used by Container.PlanUpgrade for dry runs; migrations whose SQL can't be determined without
+	// touching the database (e.g. ones that branch on existing data) may leave it nil.
+	Preview func(dialect Dialect) []string
+}
+
+// MigrationStatus describes the applied/pending state of a single registered migration, as
+// returned by Container.MigrationStatus.
+type MigrationStatus struct {
+	Namespace string
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var migrationsLock sync.Mutex
+var migrations = map[string][]Migration{}
+
+// MigrationPhase identifies which half of a migration's execution a MigrationEvent describes.
+type MigrationPhase int
+
+const (
+	// MigrationStart is emitted right before a migration's Up function runs.
+	MigrationStart MigrationPhase = iota
+	// MigrationComplete is emitted after a migration's Up function returns, whether it succeeded
+	// or failed.
+	MigrationComplete
+)
+
+// MigrationEvent describes one phase of a single migration's execution, reported to a
+// MigrationHook registered with Container.SetMigrationHook.
+type MigrationEvent struct {
+	Namespace string
+	Version   int
+	Name      string
+	Phase     MigrationPhase
+	// Duration is only set on MigrationComplete.
+	Duration time.Duration
+	// Err is only set on MigrationComplete, and only when the migration failed.
+	Err error
+}
+
+// MigrationHook is called before and after each migration UpgradeContext applies, for
+// observability (logging, metrics, tracing).
+type MigrationHook func(MigrationEvent)
+
+var migrationHooks sync.Map // map[*Container]MigrationHook
+
+// SetMigrationHook registers a callback invoked before and after each migration Upgrade applies.
+// Pass nil to remove a previously set hook.
+func (c *Container) SetMigrationHook(hook MigrationHook) {
+	if hook == nil {
+		migrationHooks.Delete(c)
+		return
+	}
+	migrationHooks.Store(c, hook)
+}
+
+func (c *Container) migrationHook() MigrationHook {
+	v, ok := migrationHooks.Load(c)
+	if !ok {
+		return nil
+	}
+	return v.(MigrationHook)
+}
+
+// RegisterMigration adds a migration to the registry that Upgrade walks. Migrations within a
+// namespace are applied in ascending Version order; call this before Upgrade.
+//
+// Registering the same namespace/version twice panics, since that almost always means two
+// integrations picked the same namespace by mistake.
+func (c *Container) RegisterMigration(m Migration) {
+	registerMigration(m)
+}
+
+func registerMigration(m Migration) {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	for _, existing := range migrations[m.Namespace] {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("sqlstore: migration %s/%d is already registered", m.Namespace, m.Version))
+		}
+	}
+	migrations[m.Namespace] = append(migrations[m.Namespace], m)
+	sort.Slice(migrations[m.Namespace], func(i, j int) bool {
+		return migrations[m.Namespace][i].Version < migrations[m.Namespace][j].Version
+	})
+}
+
+func registeredMigrations(namespace string) []Migration {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	out := make([]Migration, len(migrations[namespace]))
+	copy(out, migrations[namespace])
+	return out
+}
+
+func registeredNamespaces() []string {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	out := make([]string, 0, len(migrations))
+	for ns := range migrations {
+		out = append(out, ns)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func init() {
+	migs := [...]struct {
+		up         upgradeFunc
+		preview    func(Dialect) []string
+		idempotent bool
+	}{
+		// v1's CREATE TABLE statements all use IF NOT EXISTS, so it's safe to re-run even if
+		// EnableStores already created some of these tables before Upgrade ran.
+		{upgradeV1, upgradeV1Preview, true},
+		{upgradeV2, upgradeV2Preview, false},
+		{upgradeV3, upgradeV3Preview, false},
+		{upgradeV4, upgradeV4Preview, false},
+	}
+	for i, m := range migs {
+		registerMigration(Migration{
+			Namespace:  whatsmeowNamespace,
+			Version:    i + 1,
+			Name:       fmt.Sprintf("v%d", i+1),
+			Up:         m.up,
+			Preview:    m.preview,
+			Idempotent: m.idempotent,
+		})
+	}
+}
+
+func (c *Container) ensureVersionTable() error {
+	_, err := c.db.Exec(`CREATE TABLE IF NOT EXISTS whatsmeow_version (version INTEGER)`)
+	if err != nil {
+		return err
+	}
+	// Best-effort additions for installs upgrading from the single-column version table used
+	// before namespaced migrations existed. Errors are ignored: most dialects don't support
+	// "ADD COLUMN IF NOT EXISTS" and will simply fail once the columns are already there.
+	for _, stmt := range []string{
+		"ALTER TABLE whatsmeow_version ADD COLUMN namespace TEXT",
+		"ALTER TABLE whatsmeow_version ADD COLUMN name TEXT",
+		"ALTER TABLE whatsmeow_version ADD COLUMN applied_at TIMESTAMP",
+	} {
+		_, _ = c.db.Exec(stmt)
+	}
+	_, err = c.db.Exec("UPDATE whatsmeow_version SET namespace=? WHERE namespace IS NULL OR namespace=''", whatsmeowNamespace)
+	return err
+}
+
+// lockRowVersion is a reserved, never-applied version number used for a per-namespace placeholder
+// row that getVersionTx locks with SELECT ... FOR UPDATE. Aggregates like MAX(version) can't be
+// locked directly on Postgres or MySQL, so the row lock has to be taken against a real row instead.
+const lockRowVersion = -1
+
+func (c *Container) getVersion(namespace string) (int, error) {
+	if err := c.ensureVersionTable(); err != nil {
+		return -1, err
+	}
+	version := 0
+	row := c.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM whatsmeow_version WHERE namespace=? AND version>?", namespace, lockRowVersion)
+	if row != nil {
+		_ = row.Scan(&version)
+	}
+	return version, nil
+}
+
+// ensureLockRow makes sure namespace has its lock placeholder row, inserting one if it's missing.
+// It's idempotent and safe to call every time upgradeNamespace runs.
+func (c *Container) ensureLockRow(namespace string) error {
+	_, err := c.db.Exec(
+		"INSERT INTO whatsmeow_version (namespace, version, name, applied_at) "+
+			"SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM whatsmeow_version WHERE namespace=? AND version=?)",
+		namespace, lockRowVersion, "(lock row)", time.Now(), namespace, lockRowVersion)
+	return err
+}
+
+func (c *Container) setVersion(tx *sql.Tx, namespace string, version int, name string) error {
+	_, err := tx.Exec("DELETE FROM whatsmeow_version WHERE namespace=? AND version=?", namespace, version)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO whatsmeow_version (namespace, version, name, applied_at) VALUES (?, ?, ?, ?)", namespace, version, name, time.Now())
+	return err
+}
+
+func (c *Container) deleteVersion(tx *sql.Tx, namespace string, version int) error {
+	_, err := tx.Exec("DELETE FROM whatsmeow_version WHERE namespace=? AND version=?", namespace, version)
+	return err
+}
+
+// getVersionTx re-reads the current version inside an in-progress migration transaction. On
+// dialects that support row locking, it first takes a SELECT ... FOR UPDATE on namespace's lock
+// row (see ensureLockRow/lockRowVersion) — a real row, since Postgres and MySQL refuse FOR UPDATE
+// on an aggregate query — so that if a concurrent instance committed a migration between Upgrade's
+// initial getVersion call and this transaction starting, that write is observed instead of silently
+// being raced.
+func (c *Container) getVersionTx(ctx context.Context, tx *sql.Tx, namespace string) (int, error) {
+	if name := c.dialect; name == "postgres" || name == "pgx" || name == "mysql" {
+		lockQuery := "SELECT version FROM whatsmeow_version WHERE namespace=? AND version=? FOR UPDATE"
+		var sentinel int
+		if err := tx.QueryRowContext(ctx, lockQuery, namespace, lockRowVersion).Scan(&sentinel); err != nil {
+			return -1, err
+		}
+	}
+	version := 0
+	row := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM whatsmeow_version WHERE namespace=? AND version>?", namespace, lockRowVersion)
+	if err := row.Scan(&version); err != nil {
+		return -1, err
+	}
+	return version, nil
+}
+
+// Upgrade upgrades the database from the current to the latest version available. It's a thin
+// wrapper around UpgradeContext(context.Background()) kept for compatibility.
+func (c *Container) Upgrade() error {
+	return c.UpgradeContext(context.Background())
+}
+
+// UpgradeContext is like Upgrade, but honors ctx cancellation between migrations (and within each
+// migration's own statements, since ctx is threaded down to Migration.Up).
+//
+// It applies whatsmeow's own migrations first, then every other namespace a third-party
+// integrator has registered with RegisterMigration, so registering a migration is enough to have
+// it applied by the Upgrade call integrators already make — they don't also need to know to call
+// it again per namespace. Namespaces reserved for whatsmeow's own optional, opt-in tables (see
+// EnableStores) are excluded, since those are only meant to run when explicitly enabled.
+func (c *Container) UpgradeContext(ctx context.Context) error {
+	if err := c.upgradeNamespace(ctx, whatsmeowNamespace); err != nil {
+		return err
+	}
+	for _, ns := range registeredNamespaces() {
+		if ns == whatsmeowNamespace || strings.HasPrefix(ns, whatsmeowNamespace+".") {
+			continue
+		}
+		if err := c.upgradeNamespace(ctx, ns); err != nil {
+			return fmt.Errorf("applying migrations for namespace %q: %w", ns, err)
+		}
+	}
+	return nil
+}
+
+// UpgradeNamespace applies only the migrations registered under namespace, ignoring every other
+// namespace. This is what EnableStores uses to opt into one whatsmeow-provided store at a time,
+// and integrators can call it directly if they want the same per-namespace control instead of
+// relying on UpgradeContext walking every registered namespace for them.
+func (c *Container) UpgradeNamespace(ctx context.Context, namespace string) error {
+	return c.upgradeNamespace(ctx, namespace)
+}
+
+func (c *Container) upgradeNamespace(ctx context.Context, namespace string) error {
+	migs := registeredMigrations(namespace)
+	version, err := c.getVersion(namespace)
+	if err != nil {
+		return err
+	}
+	if version > len(migs) {
+		return fmt.Errorf("%w: %s is at v%d, but this binary only knows about %d migrations", ErrUnknownVersion, namespace, version, len(migs))
+	}
+	if len(migs) == 0 {
+		return nil
+	}
+	if err = c.ensureLockRow(namespace); err != nil {
+		return err
+	}
+
+	hook := c.migrationHook()
+	for ; version < len(migs); version++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		m := migs[version]
+		var tx *sql.Tx
+		tx, err = c.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		// Re-check the version under a row lock now that we hold a transaction, in case another
+		// instance applied migrations concurrently between the check above and this Begin.
+		var actual int
+		actual, err = c.getVersionTx(ctx, tx, namespace)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if actual != m.Version-1 {
+			_ = tx.Rollback()
+			return fmt.Errorf("sqlstore: %s version changed concurrently (expected v%d, found v%d); retry Upgrade", namespace, m.Version-1, actual)
+		}
+
+		c.log.Infof("Upgrading %s database to v%d: %s", namespace, m.Version, m.Name)
+		if hook != nil {
+			hook(MigrationEvent{Namespace: namespace, Version: m.Version, Name: m.Name, Phase: MigrationStart})
+		}
+		start := time.Now()
+		err = m.Up(ctx, tx, c)
+		if hook != nil {
+			hook(MigrationEvent{Namespace: namespace, Version: m.Version, Name: m.Name, Phase: MigrationComplete, Duration: time.Since(start), Err: err})
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err = c.setVersion(tx, namespace, m.Version, m.Name); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpgradeTo upgrades or rolls the whatsmeow namespace back to exactly the given version, applying
+// or reverting whichever migrations lie between the current version and it. Rolling back past a
+// migration with no Down function returns an error instead of silently leaving the schema ahead
+// of the requested version.
+func (c *Container) UpgradeTo(version int) error {
+	migs := registeredMigrations(whatsmeowNamespace)
+	if version < 0 || version > len(migs) {
+		return fmt.Errorf("sqlstore: version %d is out of range (0-%d)", version, len(migs))
+	}
+	current, err := c.getVersion(whatsmeowNamespace)
+	if err != nil {
+		return err
+	}
+
+	for current < version {
+		m := migs[current]
+		tx, err := c.db.Begin()
+		if err != nil {
+			return err
+		}
+		c.log.Infof("Upgrading %s database to v%d: %s", whatsmeowNamespace, m.Version, m.Name)
+		if err = m.Up(context.Background(), tx, c); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = c.setVersion(tx, whatsmeowNamespace, m.Version, m.Name); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		current++
+	}
+
+	for current > version {
+		m := migs[current-1]
+		if m.Down == nil {
+			return fmt.Errorf("sqlstore: migration %s/%d (%s) has no Down step, can't roll back past it", m.Namespace, m.Version, m.Name)
+		}
+		tx, err := c.db.Begin()
+		if err != nil {
+			return err
+		}
+		c.log.Infof("Rolling back %s database from v%d: %s", whatsmeowNamespace, m.Version, m.Name)
+		if err = m.Down(context.Background(), tx, c); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = c.deleteVersion(tx, whatsmeowNamespace, m.Version); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		current--
+	}
+
+	return nil
+}
+
+// MigrationStatus returns the applied/pending state of every registered migration across all
+// namespaces, ordered by namespace then version.
+func (c *Container) MigrationStatus() ([]MigrationStatus, error) {
+	if err := c.ensureVersionTable(); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query("SELECT namespace, version, applied_at FROM whatsmeow_version WHERE version>?", lockRowVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct {
+		namespace string
+		version   int
+	}
+	applied := make(map[key]time.Time)
+	// A version table upgraded from the single-column form holds one row for the latest version,
+	// with a NULL applied_at; every version up to the highest one recorded counts as applied, as it
+	// does for upgradeNamespace.
+	maxVersion := make(map[string]int)
+	for rows.Next() {
+		var ns string
+		var version int
+		var appliedAt sql.NullTime
+		if err = rows.Scan(&ns, &version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[key{ns, version}] = appliedAt.Time
+		if version > maxVersion[ns] {
+			maxVersion[ns] = version
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []MigrationStatus
+	for _, ns := range registeredNamespaces() {
+		for _, m := range registeredMigrations(ns) {
+			appliedAt, ok := applied[key{ns, m.Version}]
+			out = append(out, MigrationStatus{
+				Namespace: ns,
+				Version:   m.Version,
+				Name:      m.Name,
+				Applied:   ok || m.Version <= maxVersion[ns],
+				AppliedAt: appliedAt,
+			})
+		}
+	}
+	return out, nil
+}
+
+// PlannedStatement is one migration's contribution to a Container.PlanUpgrade dry run.
+type PlannedStatement struct {
+	Namespace string
+	Version   int
+	Name      string
+	// SQL is the DDL this migration would execute, for this Container's dialect. It's empty if
+	// the migration doesn't support previewing.
+	SQL []string
+}
+
+// PlanUpgrade reports the migrations Upgrade would apply to the "whatsmeow" namespace and, for
+// those that support it, the DDL each would run, without running any migration. Reading the current
+// version does create or extend the whatsmeow_version table first, as Upgrade does (see
+// ensureVersionTable). This is meant for operators who need to review schema changes before
+// applying them to a production database.
+func (c *Container) PlanUpgrade() ([]PlannedStatement, error) {
+	return c.planUpgradeNamespace(whatsmeowNamespace)
+}
+
+func (c *Container) planUpgradeNamespace(namespace string) ([]PlannedStatement, error) {
+	migs := registeredMigrations(namespace)
+	version, err := c.getVersion(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migs) {
+		return nil, fmt.Errorf("%w: %s is at v%d, but this binary only knows about %d migrations", ErrUnknownVersion, namespace, version, len(migs))
+	}
+
+	dialect := c.Dialect()
+	var out []PlannedStatement
+	for ; version < len(migs); version++ {
+		m := migs[version]
+		stmt := PlannedStatement{Namespace: m.Namespace, Version: m.Version, Name: m.Name}
+		if m.Preview != nil {
+			stmt.SQL = m.Preview(dialect)
+		}
+		out = append(out, stmt)
+	}
+	return out, nil
+}
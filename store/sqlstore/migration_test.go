@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import "testing"
+
+func TestRegisterMigrationOrdersByVersion(t *testing.T) {
+	const ns = "test.register-order"
+	registerMigration(Migration{Namespace: ns, Version: 2, Name: "second"})
+	registerMigration(Migration{Namespace: ns, Version: 1, Name: "first"})
+
+	migs := registeredMigrations(ns)
+	if len(migs) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migs))
+	}
+	if migs[0].Version != 1 || migs[1].Version != 2 {
+		t.Fatalf("expected versions [1, 2], got [%d, %d]", migs[0].Version, migs[1].Version)
+	}
+}
+
+func TestRegisterMigrationPanicsOnDuplicateVersion(t *testing.T) {
+	const ns = "test.register-duplicate"
+	registerMigration(Migration{Namespace: ns, Version: 1, Name: "first"})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a duplicate namespace/version to panic")
+		}
+	}()
+	registerMigration(Migration{Namespace: ns, Version: 1, Name: "first-again"})
+}
+
+func TestRegisteredNamespacesIncludesBuiltins(t *testing.T) {
+	namespaces := registeredNamespaces()
+	found := false
+	for _, ns := range namespaces {
+		if ns == whatsmeowNamespace {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("expected %q among registered namespaces, got %v", whatsmeowNamespace, namespaces)
+	}
+	for i := 1; i < len(namespaces); i++ {
+		if namespaces[i-1] > namespaces[i] {
+			t.Fatalf("registeredNamespaces() not sorted: %v", namespaces)
+		}
+	}
+}
+
+func TestRegisteredMigrationsReturnsCopy(t *testing.T) {
+	const ns = "test.register-copy"
+	registerMigration(Migration{Namespace: ns, Version: 1, Name: "first"})
+
+	migs := registeredMigrations(ns)
+	migs[0].Name = "mutated"
+
+	if registeredMigrations(ns)[0].Name != "first" {
+		t.Fatal("registeredMigrations() leaked its internal slice to the caller")
+	}
+}
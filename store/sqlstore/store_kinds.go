@@ -0,0 +1,347 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// StoreKind identifies one topic-scoped group of whatsmeow_* tables that Container.EnableStores
+// can opt a Container into independently of the others, for integrators who supply their own
+// storage for some of whatsmeow's data (e.g. a bridge with its own contacts/chat-settings store).
+type StoreKind string
+
+const (
+	StoreIdentity     StoreKind = "identity"
+	StorePreKeys      StoreKind = "prekeys"
+	StoreSessions     StoreKind = "sessions"
+	StoreSenderKeys   StoreKind = "senderkeys"
+	StoreAppState     StoreKind = "appstate"
+	StoreContacts     StoreKind = "contacts"
+	StoreChatSettings StoreKind = "chatsettings"
+	StoreMsgSecrets   StoreKind = "msgsecrets"
+	StorePrivacy      StoreKind = "privacy"
+)
+
+// storeNamespace returns the migration namespace a StoreKind's tables are tracked under. These are
+// independent of the "whatsmeow" namespace Upgrade uses, so enabling stores individually doesn't
+// interact with the all-in-one migration path existing installs already rely on.
+func storeNamespace(kind StoreKind) string {
+	return "whatsmeow." + string(kind)
+}
+
+// EnableStores opts this Container into the tables backing each given StoreKind, without touching
+// the tables for any other kind. whatsmeow_device (StoreIdentity) is always included first, since
+// every other store's tables except StorePrivacy's have a foreign key to it.
+//
+// This is an alternative to Upgrade for integrators who want to supply their own storage for some
+// of whatsmeow's data (e.g. a bridge with its own contacts/chat-settings store) instead of the
+// fixed set of tables Upgrade creates. The two can be mixed safely in either order: if Upgrade's
+// "whatsmeow" namespace has already created every table, EnableStores just records each kind's
+// namespace as already applied instead of re-running its DDL; and every CREATE TABLE these DDL
+// builders emit (upgradeV1 composes the very same ones EnableStores registers per-kind) uses IF
+// NOT EXISTS, so calling EnableStores first and Upgrade later doesn't fail against tables
+// EnableStores already created.
+func (c *Container) EnableStores(kinds ...StoreKind) error {
+	ctx := context.Background()
+	legacyVersion, err := c.getVersion(whatsmeowNamespace)
+	if err != nil {
+		return err
+	}
+
+	want := append([]StoreKind{StoreIdentity}, kinds...)
+	seen := map[StoreKind]bool{}
+	for _, kind := range want {
+		if seen[kind] {
+			continue
+		}
+		seen[kind] = true
+		// The "whatsmeow" namespace creates most tables in v1, but message secrets in v3 and
+		// privacy tokens in v4.
+		createdIn := 1
+		switch kind {
+		case StoreMsgSecrets:
+			createdIn = 3
+		case StorePrivacy:
+			createdIn = 4
+		}
+		if legacyVersion >= createdIn {
+			if err := c.markStoreNamespaceApplied(kind); err != nil {
+				return fmt.Errorf("enabling %s store: %w", kind, err)
+			}
+			continue
+		}
+		if err := c.upgradeNamespace(ctx, storeNamespace(kind)); err != nil {
+			return fmt.Errorf("enabling %s store: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// markStoreNamespaceApplied records kind's namespace as already at v1 without running any DDL,
+// since Upgrade's "whatsmeow" namespace migrations already created its tables.
+func (c *Container) markStoreNamespaceApplied(kind StoreKind) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := c.setVersion(tx, storeNamespace(kind), 1, fmt.Sprintf("create %s tables (already created by the whatsmeow namespace)", kind)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func identityDDL(dialect Dialect) []string {
+	blob := dialect.BlobType()
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_device (
+	jid VARCHAR(255) ,
+
+	registration_id BIGINT NOT NULL CHECK ( registration_id >= 0 AND registration_id < 4294967296 ),
+
+	noise_key    %[1]s NOT NULL CHECK ( length(noise_key) = 32 ),
+	identity_key %[1]s NOT NULL CHECK ( length(identity_key) = 32 ),
+
+	signed_pre_key     %[1]s   NOT NULL CHECK ( length(signed_pre_key) = 32 ),
+	signed_pre_key_id  INTEGER NOT NULL CHECK ( signed_pre_key_id >= 0 AND signed_pre_key_id < 16777216 ),
+	signed_pre_key_sig %[1]s   NOT NULL CHECK ( length(signed_pre_key_sig) = 64 ),
+
+	adv_key         %[1]s NOT NULL,
+	adv_details     %[1]s NOT NULL,
+	adv_account_sig %[1]s NOT NULL CHECK ( length(adv_account_sig) = 64 ),
+	adv_device_sig  %[1]s NOT NULL CHECK ( length(adv_device_sig) = 64 ),
+
+	platform      TEXT NOT NULL,
+	business_name TEXT NOT NULL,
+	push_name     TEXT NOT NULL,
+	PRIMARY KEY (jid)
+);`, blob),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_identity_keys (
+	our_jid  VARCHAR(255),
+	their_id TEXT,
+	identity %s NOT NULL CHECK ( length(identity) = 32 ),
+
+	PRIMARY KEY (our_jid, their_id(20)),
+	CONSTRAINT fk_wm_identity_keys
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, blob),
+	}
+}
+
+func preKeysDDL(dialect Dialect) []string {
+	key := dialect.QuoteIdent("key")
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_pre_keys (
+	jid      VARCHAR(255),
+	key_id   INTEGER   CHECK ( key_id >= 0 AND key_id < 16777216 ),
+	%[2]s   %[1]s  NOT NULL CHECK ( length(%[2]s) = 32 ),
+	uploaded BOOLEAN NOT NULL,
+
+	PRIMARY KEY (jid, key_id),
+	CONSTRAINT fk_wm_pre_keys
+		FOREIGN KEY (jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, dialect.BlobType(), key)}
+}
+
+func sessionsDDL(dialect Dialect) []string {
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_sessions (
+	our_jid  VARCHAR(255),
+	their_id TEXT,
+	session  %s,
+
+	PRIMARY KEY (our_jid, their_id(20)),
+	CONSTRAINT fk_wm_sessions
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, dialect.BlobType())}
+}
+
+func senderKeysDDL(dialect Dialect) []string {
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_sender_keys (
+	our_jid    VARCHAR(255),
+	chat_id    TEXT,
+	sender_id  TEXT,
+	sender_key %s NOT NULL,
+
+	PRIMARY KEY (our_jid, chat_id(20), sender_id(20)),
+	CONSTRAINT fk_wm_sender_keys
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, dialect.BlobType())}
+}
+
+func appStateDDL(dialect Dialect) []string {
+	blob := dialect.BlobType()
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_sync_keys (
+	jid         VARCHAR(255),
+	key_id      %[1]s,
+	key_data    %[1]s  NOT NULL,
+	timestamp   BIGINT NOT NULL,
+	fingerprint %[1]s  NOT NULL,
+
+	PRIMARY KEY (jid, key_id(20)),
+	CONSTRAINT fk_wm_app_state_sync_keys
+		FOREIGN KEY (jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, blob),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_version (
+	jid     VARCHAR(255),
+	name    VARCHAR(255),
+	version BIGINT NOT NULL,
+	hash    %s  NOT NULL CHECK ( length(hash) = 128 ),
+
+	PRIMARY KEY (jid, name),
+	CONSTRAINT fk_wm_app_state_version
+		FOREIGN KEY (jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, blob),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_mutation_macs (
+	jid       VARCHAR(255),
+	name      VARCHAR(255),
+	version   BIGINT,
+	index_mac %[1]s          CHECK ( length(index_mac) = 32 ),
+	value_mac %[1]s NOT NULL CHECK ( length(value_mac) = 32 ),
+
+	PRIMARY KEY (jid, name(20), version, index_mac(20)),
+	CONSTRAINT fk_wm_app_state_mutation_macs
+		FOREIGN KEY (jid, name)
+		REFERENCES whatsmeow_app_state_version (jid, name)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, blob),
+	}
+}
+
+func contactsDDL(Dialect) []string {
+	return []string{`CREATE TABLE IF NOT EXISTS whatsmeow_contacts (
+	our_jid       VARCHAR(255),
+	their_jid     TEXT,
+	first_name    TEXT,
+	full_name     TEXT,
+	push_name     TEXT,
+	business_name TEXT,
+
+	PRIMARY KEY (our_jid, their_jid(20)),
+	CONSTRAINT fk_wm_contacts
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`}
+}
+
+func chatSettingsDDL(dialect Dialect) []string {
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_chat_settings (
+	our_jid       VARCHAR(255),
+	chat_jid      TEXT,
+	muted_until   BIGINT  NOT NULL DEFAULT 0,
+	pinned        %[1]s NOT NULL DEFAULT %[2]s,
+	archived      %[1]s NOT NULL DEFAULT %[2]s,
+
+	PRIMARY KEY (our_jid, chat_jid(20)),
+	CONSTRAINT fk_wm_chat_settings
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+);`, dialect.BoolType(), dialect.BoolLiteral(false))}
+}
+
+func msgSecretsDDL(dialect Dialect) []string {
+	key := dialect.QuoteIdent("key")
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_message_secrets (
+	our_jid VARCHAR(255) NULL DEFAULT NULL,
+	chat_jid TEXT NULL DEFAULT NULL,
+	sender_jid TEXT NULL DEFAULT NULL,
+	message_id TEXT NULL DEFAULT NULL,
+	%[2]s %[1]s NOT NULL CHECK ( length(%[2]s) = 64 ),
+
+	CONSTRAINT fk_wm_msg_scrt
+		FOREIGN KEY (our_jid)
+		REFERENCES whatsmeow_device (jid)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE);`, dialect.BlobType(), key)}
+}
+
+func privacyDDL(dialect Dialect) []string {
+	return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS whatsmeow_privacy_tokens (
+	our_jid   TEXT,
+	their_jid TEXT,
+	token     %s  NOT NULL,
+	timestamp BIGINT NOT NULL,
+	PRIMARY KEY (our_jid, their_jid)
+);`, dialect.BlobType())}
+}
+
+func execDDL(ctx context.Context, tx *sql.Tx, dialect Dialect, ddl func(Dialect) []string) error {
+	for _, stmt := range ddl(dialect) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	topics := []struct {
+		kind StoreKind
+		ddl  func(Dialect) []string
+	}{
+		{StoreIdentity, identityDDL},
+		{StorePreKeys, preKeysDDL},
+		{StoreSessions, sessionsDDL},
+		{StoreSenderKeys, senderKeysDDL},
+		{StoreAppState, appStateDDL},
+		{StoreContacts, contactsDDL},
+		{StoreChatSettings, chatSettingsDDL},
+		{StoreMsgSecrets, msgSecretsDDL},
+		{StorePrivacy, privacyDDL},
+	}
+	for _, topic := range topics {
+		ddl := topic.ddl
+		registerMigration(Migration{
+			Namespace: storeNamespace(topic.kind),
+			Version:   1,
+			Name:      fmt.Sprintf("create %s tables", topic.kind),
+			Up: func(ctx context.Context, tx *sql.Tx, container *Container) error {
+				return execDDL(ctx, tx, container.Dialect(), ddl)
+			},
+			Preview:    ddl,
+			Idempotent: true,
+		})
+	}
+
+	// StoreMsgSecrets mirrors the "whatsmeow" namespace's v6 migration, so PutMessageSecret's
+	// upsert has the same unique constraint to target whether a Container got its
+	// whatsmeow_message_secrets table from Upgrade or from EnableStores(StoreMsgSecrets).
+	registerMigration(Migration{
+		Namespace: storeNamespace(StoreMsgSecrets),
+		Version:   2,
+		Name:      "add unique constraint on whatsmeow_message_secrets",
+		Up: func(ctx context.Context, tx *sql.Tx, container *Container) error {
+			return execDDL(ctx, tx, container.Dialect(), upgradeV6DDL)
+		},
+		Preview: upgradeV6DDL,
+	})
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestUpgradeV1MatchesStoreKindDDL guards against upgradeV1 (the monolithic path Upgrade takes)
+// and the per-StoreKind DDL (the opt-in path EnableStores takes) drifting apart again, since they
+// must describe the exact same tables.
+func TestUpgradeV1MatchesStoreKindDDL(t *testing.T) {
+	dialect := dialectFor("postgres")
+
+	var fromV1 []string
+	for _, ddl := range upgradeV1Topics {
+		fromV1 = append(fromV1, ddl(dialect)...)
+	}
+
+	var fromKinds []string
+	for _, kind := range []StoreKind{StoreIdentity, StorePreKeys, StoreSessions, StoreSenderKeys, StoreAppState, StoreContacts, StoreChatSettings} {
+		for _, m := range registeredMigrations(storeNamespace(kind)) {
+			if m.Preview != nil {
+				fromKinds = append(fromKinds, m.Preview(dialect)...)
+			}
+		}
+	}
+
+	if len(fromV1) != len(fromKinds) {
+		t.Fatalf("upgradeV1 emits %d statements, per-kind DDL emits %d", len(fromV1), len(fromKinds))
+	}
+	for i := range fromV1 {
+		if fromV1[i] != fromKinds[i] {
+			t.Errorf("statement %d differs:\nv1:   %s\nkind: %s", i, fromV1[i], fromKinds[i])
+		}
+	}
+	if strings.Contains(strings.Join(fromV1, " "), "adv_account_sig_key") {
+		t.Error("v1 DDL shouldn't create adv_account_sig_key; upgradeV2 adds it via ALTER TABLE")
+	}
+}